@@ -0,0 +1,183 @@
+// Copyright © 2017 The VirusTotal CLI authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Checkpoint lets a Coordinator persist which items of a long-running scan
+// have already been processed, so a mid-run failure (quota exhausted,
+// network blip, Ctrl-C) doesn't mean starting over from scratch.
+type Checkpoint interface {
+	// LoadDone returns the set of items already marked done in a previous
+	// run.
+	LoadDone() (map[string]struct{}, error)
+	// MarkDone records that item was processed successfully.
+	MarkDone(item string) error
+	// MarkFailed records that item failed with err, so it can be replayed
+	// later by `vt resume --retry-failed`.
+	MarkFailed(item string, err error) error
+}
+
+var (
+	doneBucket   = []byte("done")
+	errorsBucket = []byte("errors")
+)
+
+// BoltCheckpoint is the default Checkpoint, backed by a bbolt database kept
+// at ~/.vt/checkpoints/<resume-id>.db with a "done" bucket and an "errors"
+// bucket holding the last error message for each failed item.
+type BoltCheckpoint struct {
+	db *bolt.DB
+}
+
+// NewBoltCheckpoint opens (creating if necessary) the checkpoint database
+// for resumeID.
+func NewBoltCheckpoint(resumeID string) (*BoltCheckpoint, error) {
+	path, err := checkpointFilePath(resumeID)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(doneBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(errorsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltCheckpoint{db: db}, nil
+}
+
+// LoadDone returns every item recorded in the "done" bucket.
+func (c *BoltCheckpoint) LoadDone() (map[string]struct{}, error) {
+	done := make(map[string]struct{})
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(doneBucket).ForEach(func(k, v []byte) error {
+			done[string(k)] = struct{}{}
+			return nil
+		})
+	})
+	return done, err
+}
+
+// MarkDone records item as successfully processed and clears any previous
+// failure recorded for it.
+func (c *BoltCheckpoint) MarkDone(item string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(errorsBucket).Delete([]byte(item)); err != nil {
+			return err
+		}
+		return tx.Bucket(doneBucket).Put([]byte(item), []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+}
+
+// MarkFailed records the last error message seen for item.
+func (c *BoltCheckpoint) MarkFailed(item string, itemErr error) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(errorsBucket).Put([]byte(item), []byte(itemErr.Error()))
+	})
+}
+
+// Failed returns every item recorded in the "errors" bucket along with its
+// last error message, for `vt resume --retry-failed`.
+func (c *BoltCheckpoint) Failed() (map[string]string, error) {
+	failed := make(map[string]string)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(errorsBucket).ForEach(func(k, v []byte) error {
+			failed[string(k)] = string(v)
+			return nil
+		})
+	})
+	return failed, err
+}
+
+// Close closes the underlying bbolt database.
+func (c *BoltCheckpoint) Close() error {
+	return c.db.Close()
+}
+
+// checkpointsDir returns ~/.vt/checkpoints, creating it if necessary.
+func checkpointsDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, ".vt", "checkpoints")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func checkpointFilePath(resumeID string) (string, error) {
+	dir, err := checkpointsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, resumeID+".db"), nil
+}
+
+// ResumeID derives a stable checkpoint identifier from an arbitrary seed,
+// such as the path of the input file, for callers that don't pass an
+// explicit --resume-id.
+func ResumeID(seed string) string {
+	h := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(h[:])[:16]
+}
+
+// ListCheckpoints returns the resume IDs of every checkpoint stored under
+// ~/.vt/checkpoints, for the `vt checkpoints ls` subcommand.
+func ListCheckpoints() ([]string, error) {
+	dir, err := checkpointsDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ".db" {
+			ids = append(ids, strings.TrimSuffix(e.Name(), ".db"))
+		}
+	}
+	return ids, nil
+}
+
+// RemoveCheckpoint deletes the checkpoint state for resumeID, for the
+// `vt checkpoints rm` subcommand.
+func RemoveCheckpoint(resumeID string) error {
+	path, err := checkpointFilePath(resumeID)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -15,8 +15,11 @@ package utils
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
 	"strings"
 	"sync"
@@ -24,7 +27,6 @@ import (
 
 	vt "github.com/VirusTotal/vt-go"
 	"github.com/briandowns/spinner"
-	"github.com/plusvic/go-ansi"
 )
 
 // Coordinator coordinates the work of multiple instances of a Doer that run
@@ -33,9 +35,23 @@ type Coordinator struct {
 	Threads int
 	Spinner *spinner.Spinner
 
+	// RateLimiter, if set, gates every call to doer.Do. Nil means the
+	// Coordinator dispatches calls as fast as the Doers can take them.
+	RateLimiter RateLimiter
+
+	// ProgressWriter renders the start/result/error/summary events produced
+	// while processing items. Nil means the default ansi renderer is used,
+	// built lazily from Spinner.
+	ProgressWriter ProgressWriter
+
+	// Checkpoint, if set, is used by DoWithStringsFromReader(Context) to
+	// skip items already completed in a previous run, and is updated as
+	// items succeed or fail so the scan can be resumed later.
+	Checkpoint Checkpoint
+
 	printingWg *sync.WaitGroup
 	doerStates []DoerState
-	resultsCh  chan string
+	resultsCh  chan ProgressEvent
 }
 
 // StringReader is the interface that wraps the ReadString method.
@@ -116,15 +132,67 @@ func (f *FilteredStringReader) ReadString() (s string, err error) {
 	return s, err
 }
 
-// DoerState represents the current state of a Doer.
+// DoerState represents the current state of a Doer. The progress message and
+// the pool-wide backoff accounting can be written by a worker goroutine (Do
+// itself, or the Coordinator around it) while being read concurrently by
+// printResults, so they live behind an internal mutex and are accessed
+// through SetProgress/Progress and Backoff rather than plain fields.
 type DoerState struct {
-	Progress string
+	mu        sync.Mutex
+	progress  string
+	attempt   int
+	nextRetry time.Time
+
+	// Err can be set by a Doer's Do method after a failed call to the VT API
+	// so the Coordinator's RateLimiter has a chance to react to it, for
+	// example backing off the whole pool after a 429. It's only ever read by
+	// the same goroutine that called Do, right after it returns, so it
+	// doesn't need the mutex that guards the other fields.
+	Err error
+}
+
+// SetProgress updates the progress message shown for this Doer while Do is
+// still running. It's safe to call even though printResults may be reading
+// Progress concurrently from another goroutine.
+func (ds *DoerState) SetProgress(progress string) {
+	ds.mu.Lock()
+	ds.progress = progress
+	ds.mu.Unlock()
+}
+
+// Progress returns the last progress message set with SetProgress.
+func (ds *DoerState) Progress() string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.progress
+}
+
+// setBackoff records the pool-wide retry attempt number and when it will
+// next resume sending requests, as last reported by an AdaptiveBackoff.
+func (ds *DoerState) setBackoff(attempt int, nextRetry time.Time) {
+	ds.mu.Lock()
+	ds.attempt, ds.nextRetry = attempt, nextRetry
+	ds.mu.Unlock()
+}
+
+// Backoff returns the pool-wide retry attempt number and when the pool will
+// resume sending requests, or (0, zero Time) if it isn't backing off.
+func (ds *DoerState) Backoff() (attempt int, nextRetry time.Time) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.attempt, ds.nextRetry
 }
 
 // Doer is the interface that must be implemented for any type to be used with
-// DoWithStringsFromReader and DoWithStringsFromChannel.
+// DoWithStringsFromReader and DoWithItemsFromChannel. The context passed to
+// Do is cancelled when the coordinator is asked to stop (for example because
+// the user hit Ctrl-C), and implementations should use it to abort any
+// in-flight request to the VT API as soon as possible. The returned
+// ProgressEvent's Type should be ProgressEventResult on success or
+// ProgressEventError on failure; the Coordinator fills in Worker and, if left
+// empty, Item before handing it to the configured ProgressWriter.
 type Doer interface {
-	Do(interface{}, *DoerState) string
+	Do(ctx context.Context, item interface{}, state *DoerState) ProgressEvent
 }
 
 // NewCoordinator creates a new instance of Coordinator.
@@ -144,97 +212,205 @@ func (c *Coordinator) EnableSpinner() {
 // called once for each string, and this function doesn't exit until the
 // StringReader returns an empty string.
 func (c *Coordinator) DoWithStringsFromReader(doer Doer, reader StringReader) {
+	c.DoWithStringsFromReaderContext(context.Background(), doer, reader)
+}
+
+// DoWithStringsFromReaderContext behaves like DoWithStringsFromReader but
+// stops reading and processing new strings as soon as ctx is done, returning
+// as promptly as the in-flight Do calls allow. If Checkpoint is set, strings
+// it reports as already done are skipped.
+func (c *Coordinator) DoWithStringsFromReaderContext(ctx context.Context, doer Doer, reader StringReader) {
+	var done map[string]struct{}
+	if c.Checkpoint != nil {
+		var err error
+		if done, err = c.Checkpoint.LoadDone(); err != nil {
+			done = nil
+		}
+	}
 	ch := make(chan interface{})
 	go func() {
+		defer close(ch)
 		for s, err := reader.ReadString(); s != "" || err == nil; s, err = reader.ReadString() {
-			ch <- s
+			if _, skip := done[s]; skip {
+				continue
+			}
+			select {
+			case ch <- s:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(ch)
 	}()
-	c.DoWithItemsFromChannel(doer, ch)
+	c.DoWithItemsFromChannelContext(ctx, doer, ch)
 }
 
 // DoWithObjectsFromIterator calls the Do of a type implementing the Doer
 // interface with the objects returned by a vt.Iterator. Objects returned by the
 // iterator are put in a channel with a buffer size of bufferSize.
 func (c *Coordinator) DoWithObjectsFromIterator(doer Doer, it *vt.Iterator, bufferSize int) {
+	c.DoWithObjectsFromIteratorContext(context.Background(), doer, it, bufferSize)
+}
+
+// DoWithObjectsFromIteratorContext behaves like DoWithObjectsFromIterator but
+// stops pulling objects from it and processing them as soon as ctx is done.
+func (c *Coordinator) DoWithObjectsFromIteratorContext(ctx context.Context, doer Doer, it *vt.Iterator, bufferSize int) {
 	ch := make(chan interface{}, bufferSize)
 	go func() {
+		defer close(ch)
 		for it.Next() {
-			ch <- it.Get()
+			select {
+			case ch <- it.Get():
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(ch)
 	}()
-	c.DoWithItemsFromChannel(doer, ch)
+	c.DoWithItemsFromChannelContext(ctx, doer, ch)
 }
 
 // DoWithItemsFromChannel calls the Do method of a type implementing the Doer
 // interface with items read from a channel. This function doesn't exit until
 // the channel is closed.
 func (c *Coordinator) DoWithItemsFromChannel(doer Doer, ch <-chan interface{}) {
+	c.DoWithItemsFromChannelContext(context.Background(), doer, ch)
+}
 
-	c.resultsCh = make(chan string, c.Threads)
+// DoWithItemsFromChannelContext behaves like DoWithItemsFromChannel but stops
+// the workers as soon as ctx is done. Once that happens the workers stop
+// pulling new items from ch, the context passed to any in-flight Do call is
+// already cancelled so it can abort its VT API request, the results channel
+// is drained, the spinner is stopped and the function returns.
+func (c *Coordinator) DoWithItemsFromChannelContext(ctx context.Context, doer Doer, ch <-chan interface{}) {
+
+	c.resultsCh = make(chan ProgressEvent, c.Threads)
 	c.doerStates = make([]DoerState, c.Threads)
 	wg := &sync.WaitGroup{}
 
 	for i := 0; i < c.Threads; i++ {
 		wg.Add(1)
 		go func(i int) {
-			for arg := range ch {
-				c.resultsCh <- doer.Do(arg, &c.doerStates[i])
-				c.doerStates[i].Progress = ""
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case arg, ok := <-ch:
+					if !ok {
+						return
+					}
+					if c.RateLimiter != nil {
+						if err := c.RateLimiter.Wait(ctx); err != nil {
+							return
+						}
+						c.updateBackoffState(i)
+					}
+					item := fmt.Sprintf("%v", arg)
+					select {
+					case c.resultsCh <- ProgressEvent{Type: ProgressEventStart, Worker: i, Item: item}:
+					case <-ctx.Done():
+						return
+					}
+					c.doerStates[i].Err = nil
+					ev := doer.Do(ctx, arg, &c.doerStates[i])
+					ev.Worker = i
+					if ev.Item == "" {
+						ev.Item = item
+					}
+					if ab, ok := c.RateLimiter.(*AdaptiveBackoff); ok {
+						if c.doerStates[i].Err != nil {
+							ab.Backoff(c.doerStates[i].Err)
+						} else {
+							ab.Reset()
+						}
+						c.updateBackoffState(i)
+					}
+					if c.Checkpoint != nil {
+						var checkpointErr error
+						switch ev.Type {
+						case ProgressEventResult:
+							checkpointErr = c.Checkpoint.MarkDone(item)
+						case ProgressEventError:
+							checkpointErr = c.Checkpoint.MarkFailed(item, errors.New(ev.Error))
+						}
+						if checkpointErr != nil {
+							fmt.Fprintf(os.Stderr, "vt: checkpoint: %v\n", checkpointErr)
+						}
+					}
+					c.doerStates[i].SetProgress("")
+					select {
+					case c.resultsCh <- ev:
+					case <-ctx.Done():
+						return
+					}
+				}
 			}
-			wg.Done()
 		}(i)
 	}
 
 	c.printingWg = &sync.WaitGroup{}
 	c.printingWg.Add(1)
 
-	go c.printResults()
+	go c.printResults(ctx)
 
 	wg.Wait()
 	close(c.resultsCh)
 	c.printingWg.Wait()
 }
 
-func (c *Coordinator) printResults() {
+// updateBackoffState copies the AdaptiveBackoff's pool-wide retry accounting,
+// if any, into the given worker's DoerState so printResults can show it.
+func (c *Coordinator) updateBackoffState(worker int) {
+	ab, ok := c.RateLimiter.(*AdaptiveBackoff)
+	if !ok {
+		return
+	}
+	attempt, resumeAt := ab.Status()
+	c.doerStates[worker].setBackoff(attempt, resumeAt)
+}
+
+// progressWriter returns the configured ProgressWriter, building the default
+// ansi one from Spinner the first time it's needed.
+func (c *Coordinator) progressWriter() ProgressWriter {
+	if c.ProgressWriter == nil {
+		c.ProgressWriter = newAnsiProgressWriter(c.Spinner)
+	}
+	return c.ProgressWriter
+}
+
+func (c *Coordinator) printResults(ctx context.Context) {
+	pw := c.progressWriter()
+	ok, failed := 0, 0
+	account := func(ev ProgressEvent) {
+		switch ev.Type {
+		case ProgressEventResult:
+			ok++
+		case ProgressEventError:
+			failed++
+		}
+	}
 Loop:
 	for {
-		if c.Spinner != nil {
-			c.Spinner.Start()
-		}
 		select {
-		case res, ok := <-c.resultsCh:
-			if !ok {
+		case ev, isOpen := <-c.resultsCh:
+			if !isOpen {
 				break Loop
 			}
-			if c.Spinner != nil {
-				c.Spinner.Stop()
+			account(ev)
+			pw.Write(ev)
+		case <-ctx.Done():
+			// Drain whatever is already buffered in resultsCh before giving
+			// up so we don't leave finished results unreported, then wait
+			// for the channel to be closed by DoWithItemsFromChannelContext.
+			for ev := range c.resultsCh {
+				account(ev)
+				pw.Write(ev)
 			}
-			ansi.Printf("%s", res)
-			ansi.EraseInLine(0) // Clear to the end of the line.
-			fmt.Println()
+			break Loop
 		default:
-			// Print progress for pending workers
-			lines := 0
-			for _, ds := range c.doerStates {
-				if ds.Progress != "" {
-					ansi.Printf("%s", ds.Progress)
-					ansi.EraseInLine(0) // Clear to the end of the line.
-					fmt.Println()
-					lines++
-				}
-			}
-			time.Sleep(time.Millisecond * 250)
-			if lines > 0 {
-				// Move cursor up, to the line it was before printing worker's progress
-				ansi.CursorPreviousLine(lines)
-			}
+			pw.Tick(c.doerStates)
 		}
 	}
-	if c.Spinner != nil {
-		c.Spinner.Stop()
-	}
+	pw.Summary(ok, failed)
+	pw.Close()
 	c.printingWg.Done()
 }
@@ -0,0 +1,233 @@
+// Copyright © 2017 The VirusTotal CLI authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/briandowns/spinner"
+	"github.com/plusvic/go-ansi"
+	"golang.org/x/term"
+)
+
+// ProgressEventType identifies what kind of event a ProgressEvent carries.
+type ProgressEventType string
+
+// The event types a Coordinator emits while working through a batch of
+// items. Start and Progress describe a Doer that's still working, Result and
+// Error its outcome for one item, and Summary the totals once every item has
+// been processed.
+const (
+	ProgressEventStart    ProgressEventType = "start"
+	ProgressEventProgress ProgressEventType = "progress"
+	ProgressEventResult   ProgressEventType = "result"
+	ProgressEventError    ProgressEventType = "error"
+	ProgressEventSummary  ProgressEventType = "summary"
+)
+
+// ProgressEvent describes one step of a Doer's work on an item. Do
+// implementations return one to report their outcome; the Coordinator fills
+// in Worker and, if left empty, Item before handing it to the configured
+// ProgressWriter.
+type ProgressEvent struct {
+	Type    ProgressEventType `json:"type"`
+	Worker  int               `json:"worker"`
+	Item    string            `json:"item,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Output  interface{}       `json:"output,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// ProgressWriter renders the events produced while a Coordinator processes
+// items. Write is called for every event read off the results channel
+// (start, result and error), Tick periodically while workers are still
+// running so a long Do call can report sub-progress through
+// DoerState.SetProgress, and Summary once every item has been processed.
+type ProgressWriter interface {
+	Write(ev ProgressEvent)
+	Tick(states []DoerState)
+	Summary(ok, failed int)
+	Close()
+}
+
+// ProgressMode selects which ProgressWriter a Coordinator should use.
+type ProgressMode string
+
+// The progress modes selectable through the --progress root flag.
+const (
+	// ProgressAuto picks ProgressTTY if stdout is a terminal, ProgressPlain
+	// otherwise.
+	ProgressAuto ProgressMode = "auto"
+	// ProgressPlain renders results with the ansi writer but without the
+	// spinner or in-place progress redraws, suitable for logs and CI output.
+	ProgressPlain ProgressMode = "plain"
+	// ProgressTTY renders results with the spinner and in-place progress
+	// redraws, suitable for an interactive terminal.
+	ProgressTTY ProgressMode = "tty"
+	// ProgressJSON emits one JSON object per line describing every event,
+	// suitable for piping vt into another program.
+	ProgressJSON ProgressMode = "json"
+)
+
+// NewProgressWriter creates the ProgressWriter for mode, writing to out.
+// spinner is only used in ProgressTTY mode (and in ProgressAuto when out is a
+// terminal); it may be nil.
+func NewProgressWriter(mode ProgressMode, out *os.File, spinner *spinner.Spinner) ProgressWriter {
+	switch mode {
+	case ProgressJSON:
+		return newJSONProgressWriter(out)
+	case ProgressTTY:
+		return newAnsiProgressWriter(spinner)
+	case ProgressPlain:
+		return &ansiProgressWriter{plain: true}
+	default: // ProgressAuto
+		if term.IsTerminal(int(out.Fd())) {
+			return newAnsiProgressWriter(spinner)
+		}
+		return &ansiProgressWriter{plain: true}
+	}
+}
+
+// ansiProgressWriter is the default ProgressWriter, preserving the ANSI
+// rendering the CLI has always used: results are printed as they arrive and,
+// while workers are still busy, their DoerState progress message is redrawn
+// in place every tick.
+type ansiProgressWriter struct {
+	spinner *spinner.Spinner
+
+	// plain disables the in-place redraw of workers' progress messages.
+	plain bool
+}
+
+func newAnsiProgressWriter(spinner *spinner.Spinner) *ansiProgressWriter {
+	return &ansiProgressWriter{spinner: spinner}
+}
+
+func (w *ansiProgressWriter) Write(ev ProgressEvent) {
+	switch ev.Type {
+	case ProgressEventResult, ProgressEventError:
+		if w.spinner != nil {
+			w.spinner.Stop()
+		}
+		ansi.Printf("%s", w.render(ev))
+		ansi.EraseInLine(0) // Clear to the end of the line.
+		fmt.Println()
+	}
+}
+
+func (w *ansiProgressWriter) render(ev ProgressEvent) string {
+	if ev.Type == ProgressEventError {
+		return ev.Error
+	}
+	return fmt.Sprintf("%v", ev.Output)
+}
+
+func (w *ansiProgressWriter) Tick(states []DoerState) {
+	if w.plain {
+		time.Sleep(time.Millisecond * 250)
+		return
+	}
+	if w.spinner != nil {
+		w.spinner.Start()
+	}
+	lines := 0
+	for i := range states {
+		progress := states[i].Progress()
+		if attempt, nextRetry := states[i].Backoff(); !nextRetry.IsZero() {
+			progress = fmt.Sprintf("%s (retry %d, resuming in %s)",
+				progress, attempt, time.Until(nextRetry).Round(time.Second))
+		}
+		if progress != "" {
+			ansi.Printf("%s", progress)
+			ansi.EraseInLine(0) // Clear to the end of the line.
+			fmt.Println()
+			lines++
+		}
+	}
+	time.Sleep(time.Millisecond * 250)
+	if lines > 0 {
+		// Move cursor up, to the line it was before printing worker's progress
+		ansi.CursorPreviousLine(lines)
+	}
+}
+
+// Summary is a no-op: the ansi writer has never printed a final tally, only
+// the per-item results as they streamed by.
+func (w *ansiProgressWriter) Summary(ok, failed int) {}
+
+func (w *ansiProgressWriter) Close() {
+	if w.spinner != nil {
+		w.spinner.Stop()
+	}
+}
+
+// jsonProgressWriter emits one JSON object per line describing every event,
+// so vt can be embedded in pipelines, CI jobs or a GUI wrapper.
+type jsonProgressWriter struct {
+	out io.Writer
+
+	// lastProgress holds the last progress message emitted for each worker,
+	// so Tick only emits again once it actually changes instead of repeating
+	// the same message every 250ms while a worker is busy.
+	lastProgress []string
+}
+
+func newJSONProgressWriter(out io.Writer) *jsonProgressWriter {
+	return &jsonProgressWriter{out: out}
+}
+
+func (w *jsonProgressWriter) Write(ev ProgressEvent) {
+	w.emit(ev)
+}
+
+func (w *jsonProgressWriter) Tick(states []DoerState) {
+	if len(w.lastProgress) != len(states) {
+		w.lastProgress = make([]string, len(states))
+	}
+	for i := range states {
+		progress := states[i].Progress()
+		if progress == "" || progress == w.lastProgress[i] {
+			continue
+		}
+		w.lastProgress[i] = progress
+		w.emit(ProgressEvent{Type: ProgressEventProgress, Worker: i, Message: progress})
+	}
+	time.Sleep(time.Millisecond * 250)
+}
+
+func (w *jsonProgressWriter) Summary(ok, failed int) {
+	data, err := json.Marshal(struct {
+		Type   ProgressEventType `json:"type"`
+		OK     int               `json:"ok"`
+		Failed int               `json:"failed"`
+	}{ProgressEventSummary, ok, failed})
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(w.out, string(data))
+}
+
+func (w *jsonProgressWriter) Close() {}
+
+func (w *jsonProgressWriter) emit(ev ProgressEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(w.out, string(data))
+}
@@ -0,0 +1,252 @@
+// Copyright © 2017 The VirusTotal CLI authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	vt "github.com/VirusTotal/vt-go"
+	"golang.org/x/time/rate"
+)
+
+// maxBackoff caps how long AdaptiveBackoff will ever pause the pool for, no
+// matter how many consecutive throttling errors it has seen.
+const maxBackoff = 2 * time.Minute
+
+// RateLimiter is the interface that gates how fast a Coordinator may call a
+// Doer's Do method. Wait blocks until the caller is allowed to proceed, or
+// returns ctx.Err() as soon as ctx is done.
+type RateLimiter interface {
+	Wait(ctx context.Context) error
+}
+
+// TokenBucketRateLimiter is the default RateLimiter, built on top of
+// golang.org/x/time/rate. It enforces both a steady per-minute rate and a
+// daily quota that's persisted to disk so it's respected across separate
+// invocations of vt.
+type TokenBucketRateLimiter struct {
+	limiter *rate.Limiter
+	quota   *dailyQuota
+}
+
+// NewTokenBucketRateLimiter creates a RateLimiter allowing ratePerMinute
+// requests per minute and, if dailyQuota is greater than zero, no more than
+// dailyQuota requests per calendar day across all invocations of vt. The
+// daily counter is kept in ~/.vt/quota.json (see quotaFilePath).
+func NewTokenBucketRateLimiter(ratePerMinute, dailyQuota int) (*TokenBucketRateLimiter, error) {
+	q, err := loadDailyQuota(dailyQuota)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenBucketRateLimiter{
+		limiter: rate.NewLimiter(rate.Limit(float64(ratePerMinute)/60.0), 1),
+		quota:   q,
+	}, nil
+}
+
+// Wait blocks until the per-minute rate allows another request and the daily
+// quota hasn't been exhausted yet.
+func (l *TokenBucketRateLimiter) Wait(ctx context.Context) error {
+	if err := l.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return l.quota.consume()
+}
+
+// dailyQuota tracks how many requests have been made on the current day,
+// persisting its state to a JSON file so that successive vt invocations
+// share the same daily cap.
+type dailyQuota struct {
+	mu    sync.Mutex
+	path  string
+	limit int
+	date  string
+	count int
+}
+
+type dailyQuotaFile struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// quotaFilePath returns the path of the file used to persist the daily
+// request counter, creating its parent directory if necessary.
+func quotaFilePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, ".vt")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "quota.json"), nil
+}
+
+func loadDailyQuota(limit int) (*dailyQuota, error) {
+	path, err := quotaFilePath()
+	if err != nil {
+		return nil, err
+	}
+	q := &dailyQuota{path: path, limit: limit, date: today()}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return q, nil
+		}
+		return nil, err
+	}
+	var f dailyQuotaFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		// A corrupt quota file shouldn't prevent vt from running, just start
+		// counting from zero again.
+		return q, nil
+	}
+	if f.Date == q.date {
+		q.count = f.Count
+	}
+	return q, nil
+}
+
+// consume accounts for one more request against the daily quota, returning
+// an error if doing so would exceed it.
+func (q *dailyQuota) consume() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if d := today(); d != q.date {
+		q.date = d
+		q.count = 0
+	}
+	if q.limit > 0 && q.count >= q.limit {
+		return fmt.Errorf("daily quota of %d requests exceeded, resets at midnight", q.limit)
+	}
+	q.count++
+	data, err := json.Marshal(dailyQuotaFile{Date: q.date, Count: q.count})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(q.path, data, 0600)
+}
+
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// AdaptiveBackoff wraps a RateLimiter and, on top of its regular pacing,
+// pauses every caller in the pool (not just the one that hit the limit)
+// whenever the VT API reports that we're being throttled, backing off
+// exponentially with jitter before resuming. This mirrors the dial backoff
+// used by connection pools like go-redis's: a single bad response slows down
+// the whole pool instead of letting every worker rediscover the same 429 on
+// its own.
+type AdaptiveBackoff struct {
+	RateLimiter
+
+	mu       sync.Mutex
+	attempt  int
+	resumeAt time.Time
+}
+
+// NewAdaptiveBackoff wraps rl with pool-wide backoff on throttling errors.
+func NewAdaptiveBackoff(rl RateLimiter) *AdaptiveBackoff {
+	return &AdaptiveBackoff{RateLimiter: rl}
+}
+
+// Wait waits out any backoff currently in effect before deferring to the
+// wrapped RateLimiter.
+func (b *AdaptiveBackoff) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	resumeAt := b.resumeAt
+	b.mu.Unlock()
+	if d := time.Until(resumeAt); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return b.RateLimiter.Wait(ctx)
+}
+
+// maxBackoffAttempt caps the exponent used to compute the backoff interval.
+// 1<<maxBackoffAttempt seconds already dwarfs maxBackoff, so clamping the
+// attempt counter here doesn't change the effective wait, it just keeps the
+// shift (and the jitter computed from it) from overflowing if a sustained
+// bout of throttling keeps attempt climbing.
+const maxBackoffAttempt = 10
+
+// Backoff registers a failure reported by err, pausing every subsequent Wait
+// call in the pool for an exponentially increasing, jittered interval. It's a
+// no-op if err doesn't indicate that VT is throttling us, and also a no-op if
+// the pool is already backing off, so that every worker hitting the same 429
+// window advances attempt once per window instead of once per worker.
+func (b *AdaptiveBackoff) Backoff(err error) {
+	if !isThrottlingError(err) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.resumeAt) {
+		return
+	}
+	if b.attempt < maxBackoffAttempt {
+		b.attempt++
+	}
+	d := time.Duration(1<<uint(b.attempt)) * time.Second
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(d)/2 + 1))
+	b.resumeAt = time.Now().Add(d + jitter)
+}
+
+// Reset clears the backoff state after a successful call, so a transient
+// throttling episode doesn't keep slowing down the pool forever.
+func (b *AdaptiveBackoff) Reset() {
+	b.mu.Lock()
+	b.attempt = 0
+	b.resumeAt = time.Time{}
+	b.mu.Unlock()
+}
+
+// Status returns the current retry attempt count and when the pool will
+// resume sending requests, so callers can surface it through DoerState.
+func (b *AdaptiveBackoff) Status() (attempt int, resumeAt time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.attempt, b.resumeAt
+}
+
+// isThrottlingError reports whether err is a VT API error that indicates we
+// should back off, i.e. a 429 or a quota-exceeded response.
+func isThrottlingError(err error) bool {
+	verr, ok := err.(*vt.Error)
+	if !ok {
+		return false
+	}
+	switch verr.Code {
+	case "QuotaExceededError", "TooManyRequestsError":
+		return true
+	}
+	return false
+}
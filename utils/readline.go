@@ -0,0 +1,144 @@
+// Copyright © 2017 The VirusTotal CLI authors. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+// vtCollections lists the VT collection and relationship names offered as
+// completions after an indicator kind, e.g. `vt > file <TAB>`.
+var vtCollections = []string{
+	"files", "urls", "domains", "ip_addresses", "behaviours",
+	"comments", "votes", "analyses", "graphs", "collections",
+}
+
+// ReadlineStringReader is a StringReader backed by
+// github.com/chzyer/readline. It gives the interactive `vt shell` command
+// history persisted across runs, Ctrl-R reverse search, line editing and tab
+// completion of indicator kinds (file, url, domain, ip) and VT collection
+// names. Indicators themselves (hashes, URLs, domains) are not completed.
+type ReadlineStringReader struct {
+	rl *readline.Instance
+}
+
+// NewReadlineStringReader creates a ReadlineStringReader that prompts with
+// prompt and keeps its history in ~/.vt/history.
+func NewReadlineStringReader(prompt string) (*ReadlineStringReader, error) {
+	historyFile, err := historyFilePath()
+	if err != nil {
+		return nil, err
+	}
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:          prompt,
+		HistoryFile:     historyFile,
+		AutoComplete:    newIndicatorCompleter(),
+		InterruptPrompt: "^C",
+		EOFPrompt:       "exit",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ReadlineStringReader{rl: rl}, nil
+}
+
+// ReadString reads one line typed by the user, skipping blank ones. It
+// returns io.EOF once the user exits the shell with Ctrl-D, or with Ctrl-C on
+// an empty line.
+func (r *ReadlineStringReader) ReadString() (string, error) {
+	for {
+		line, err := r.rl.Readline()
+		if err == readline.ErrInterrupt {
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+			continue
+		}
+		if err != nil {
+			return "", io.EOF
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			return line, nil
+		}
+	}
+}
+
+// Close releases the terminal and flushes history to disk.
+func (r *ReadlineStringReader) Close() error {
+	return r.rl.Close()
+}
+
+// historyFilePath returns where the shell's command history is persisted,
+// creating its parent directory if necessary.
+func historyFilePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, ".vt")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "history"), nil
+}
+
+// Regular expressions used by IndicatorKind to recognize the kind of
+// indicator the user typed. The tab completer does not use them.
+var (
+	md5Re    = regexp.MustCompile(`^[a-fA-F0-9]{32}$`)
+	sha1Re   = regexp.MustCompile(`^[a-fA-F0-9]{40}$`)
+	sha256Re = regexp.MustCompile(`^[a-fA-F0-9]{64}$`)
+	urlRe    = regexp.MustCompile(`^https?://`)
+	domainRe = regexp.MustCompile(`^[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+)
+
+// IndicatorKind classifies s as "file", "url" or "domain" depending on
+// whether it looks like a hash, a URL or a domain name, or "" if it doesn't
+// match any of them.
+func IndicatorKind(s string) string {
+	switch {
+	case md5Re.MatchString(s), sha1Re.MatchString(s), sha256Re.MatchString(s):
+		return "file"
+	case urlRe.MatchString(s):
+		return "url"
+	case domainRe.MatchString(s):
+		return "domain"
+	default:
+		return ""
+	}
+}
+
+// newIndicatorCompleter builds the tab completer for the interactive shell:
+// the indicator kinds vt understands, each followed by the VT collection and
+// relationship names that make sense as their next token.
+func newIndicatorCompleter() *readline.PrefixCompleter {
+	collectionItems := make([]readline.PrefixCompleterInterface, len(vtCollections))
+	for i, name := range vtCollections {
+		collectionItems[i] = readline.PcItem(name)
+	}
+	return readline.NewPrefixCompleter(
+		readline.PcItem("file", collectionItems...),
+		readline.PcItem("url", collectionItems...),
+		readline.PcItem("domain", collectionItems...),
+		readline.PcItem("ip", collectionItems...),
+		readline.PcItem("help"),
+		readline.PcItem("exit"),
+	)
+}